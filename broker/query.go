@@ -15,6 +15,8 @@
 package broker
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"strconv"
@@ -23,50 +25,275 @@ import (
 	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/emitter-io/emitter/broker/query"
 	"github.com/emitter-io/emitter/broker/subscription"
 	"github.com/emitter-io/emitter/security"
 	"github.com/weaveworks/mesh"
 )
 
+// tracerName identifies this package's spans in the configured tracer
+// provider.
+const tracerName = "github.com/emitter-io/emitter/broker"
+
 const (
 	idSystem = uint32(0)
 	idQuery  = uint32(3939663052)
 )
 
+// defaultQueryTimeout is how long a job waits for a response before it is
+// retried against a different peer.
+const defaultQueryTimeout = 5 * time.Second
+
+// maxInFlightPerPeer caps how many outstanding jobs a single peer may be
+// sent concurrently, so that one slow peer cannot monopolise the dispatcher.
+const maxInFlightPerPeer = 8
+
+// legacyHandlerCapacity is the buffer size given to the internal
+// subscription a HandleFunc handler runs on.
+const legacyHandlerCapacity = 64
+
+// streamBufferSize is the buffer given to a RequestStream's response
+// channel, bounding how far a slow consumer can lag before frame delivery
+// starts applying backpressure to the sending peer.
+const streamBufferSize = 16
+
 // QueryHandler represents a query handler.
 type QueryHandler func(queryType string, request []byte) (response []byte, ok bool)
 
+// StreamingHandler handles a request that may produce more than one
+// response frame. It calls emit for each frame as it becomes available and
+// returns once it is done, so the originator's stream can be closed with
+// an end-of-stream marker.
+type StreamingHandler func(queryType string, request []byte, emit func(payload []byte) error) bool
+
+// QueryManagerOption configures a QueryManager at construction time.
+type QueryManagerOption func(*QueryManager)
+
+// WithTracer configures the QueryManager to record spans through tp
+// instead of the global OpenTelemetry tracer provider, so operators can
+// plug in a Jaeger or OTLP exporter and diagnose which peer in the mesh is
+// slow or dropping specific query types.
+func WithTracer(tp trace.TracerProvider) QueryManagerOption {
+	return func(c *QueryManager) {
+		c.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// WithAwaiterStore configures the QueryManager to persist outstanding
+// queries through store instead of keeping them in memory only, so that
+// Recover can reopen them after this node restarts. This matters for
+// long-running administrative queries (e.g. keyspace scans) where a single
+// node bounce should not force the operator to reissue every outstanding
+// query. Use query.NewBadgerStore for a durable, on-disk store.
+func WithAwaiterStore(store query.AwaiterStore) QueryManagerOption {
+	return func(c *QueryManager) {
+		c.awaiters = store
+	}
+}
+
 // QueryManager represents a request-response manager.
 type QueryManager struct {
-	service  *Service       // The service to use.
-	luid     security.ID    // The locally unique id of the manager.
-	next     uint32         // The next available query identifier.
-	awaiters *sync.Map      // The map of the awaiters.
-	handlers []QueryHandler // The handlers array.
+	service    *Service           // The service to use.
+	luid       security.ID        // The locally unique id of the manager.
+	dispatcher *query.Dispatcher  // The work dispatcher used to fan out and track queries.
+	bus        *query.Bus         // The pub/sub bus incoming requests are dispatched through.
+	legacy     uint32             // The next available id for a HandleFunc subscription.
+	tracer     trace.Tracer       // Used to record spans for queries passing through this manager.
+	jobSpans   sync.Map           // The in-flight span for each dispatched job, keyed by job id.
+	awaiters   query.AwaiterStore // Where outstanding queries are persisted for Recover; defaults to in-memory.
+
+	recoveredMu sync.Mutex      // Guards recovered.
+	recovered   []*QueryAwaiter // Awaiters resumed by Start, held until claimed through Recovered.
+
+	streamMu       sync.RWMutex       // Guards streamHandlers.
+	streamHandlers []StreamingHandler // The streaming handlers array.
+	streamNext     uint32             // The next available id for a RequestStream.
+	streams        sync.Map           // The in-flight streamState for each RequestStream, keyed by id.
+}
+
+// streamState tracks a RequestStream's output channel and the context it
+// was issued with, so an incoming frame can be dropped once the caller has
+// moved on instead of blocking the cluster's delivery goroutine. It also
+// tracks which of the expected peers have not yet signalled end-of-stream,
+// since RequestStream fans out to every peer the same way Request does, and
+// the channel must stay open until every one of them is done.
+type streamState struct {
+	ch   chan Response
+	ctx  context.Context
+	mu   sync.Mutex
+	owed map[mesh.PeerName]bool // Peers that have not yet sent their "eos" marker.
+}
+
+// eosFrom records that peer signalled end-of-stream, reporting true once
+// every expected peer has done so.
+func (s *streamState) eosFrom(peer mesh.PeerName) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.owed, peer)
+	return len(s.owed) == 0
 }
 
 // newQueryManager creates a new request-response manager.
-func newQueryManager(s *Service) *QueryManager {
-	return &QueryManager{
-		service:  s,
-		luid:     security.NewID(),
-		next:     0,
-		awaiters: new(sync.Map),
-		handlers: make([]QueryHandler, 0),
+func newQueryManager(s *Service, opts ...QueryManagerOption) *QueryManager {
+	c := &QueryManager{
+		service: s,
+		luid:    security.NewID(),
+		bus:     query.NewBus(),
+		tracer:  otel.Tracer(tracerName),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	c.dispatcher = query.NewDispatcher((*querySender)(c), maxInFlightPerPeer, defaultQueryTimeout, c.awaiters)
+	c.dispatcher.OnStoreError(c.onStoreErr)
+	c.dispatcher.OnAbandon(c.onJobAbandoned)
+	return c
+}
+
+// onJobAbandoned ends the span querySender.Send opened for an abandoned
+// dispatch attempt, so a retried job's replacement attempt starts its own
+// span instead of the original being left open until process exit.
+func (c *QueryManager) onJobAbandoned(id uint32) {
+	c.endJobSpan(id, 0, query.ErrAbandoned)
 }
 
-// Start subscribes the manager to the query channel.
+// onStoreErr records a failed AwaiterStore read or write as its own span, so
+// a persistence failure (e.g. a full disk, or a failure listing awaiters on
+// Recover) is visible to whatever the configured tracer provider exports to,
+// instead of passing silently. A record that a BadgerStore skips as
+// undecodable is not reported here.
+func (c *QueryManager) onStoreErr(id uint32, err error) {
+	_, span := c.tracer.Start(context.Background(), "broker.query.store_error",
+		trace.WithAttributes(attribute.Int64("query.task_id", int64(id))))
+	span.SetStatus(codes.Error, err.Error())
+	span.End()
+}
+
+// Start subscribes the manager to the query channel, then recovers any
+// queries left outstanding by a previous run of this node, stashing them for
+// Recovered to pick up.
 func (c *QueryManager) Start() {
 	ssid := subscription.Ssid{idSystem, idQuery}
 	if ok := c.service.onSubscribe(ssid, c); ok {
 		c.service.cluster.NotifySubscribe(c.luid, ssid)
 	}
+
+	recovered := c.Recover()
+	c.recoveredMu.Lock()
+	c.recovered = append(c.recovered, recovered...)
+	c.recoveredMu.Unlock()
 }
 
-// HandleFunc adds a handler for a query.
-func (c *QueryManager) HandleFunc(handler QueryHandler) {
-	c.handlers = append(c.handlers, handler)
+// Recover reopens every query this manager had outstanding when it last
+// stopped, as recorded in its AwaiterStore: responses buffered before the
+// restart are replayed and peers that had not yet answered are re-queried.
+// With the default in-memory store this is a no-op, since nothing survives
+// the process exiting; it only does real work once WithAwaiterStore is
+// configured with a persistent implementation.
+func (c *QueryManager) Recover() []*QueryAwaiter {
+	tasks, err := c.dispatcher.Recover()
+	if err != nil {
+		// There is no task id to attribute this failure to: listing the
+		// store failed before any record was read, so every outstanding
+		// query on this node is silently lost. Report it under id 0, which
+		// can never collide with a real task id since those are minted
+		// starting at 1.
+		c.onStoreErr(0, err)
+		return nil
+	}
+
+	awaiters := make([]*QueryAwaiter, 0, len(tasks))
+	for _, task := range tasks {
+		_, span := c.tracer.Start(context.Background(), "broker.query.recover",
+			trace.WithAttributes(attribute.Int64("query.task_id", int64(task.ID))))
+		awaiters = append(awaiters, &QueryAwaiter{task: task, span: span})
+	}
+	return awaiters
+}
+
+// Recovered returns the awaiters Start resumed from the AwaiterStore on this
+// node, such as an outstanding keyspace scan, and removes them from the
+// manager so each is only handed out once. A caller runs Gather on them the
+// same way as on an awaiter returned by Request.
+func (c *QueryManager) Recovered() []*QueryAwaiter {
+	c.recoveredMu.Lock()
+	defer c.recoveredMu.Unlock()
+	r := c.recovered
+	c.recovered = nil
+	return r
+}
+
+// Close stops the manager's dispatcher and releases its AwaiterStore.
+// Closing the store matters when it is a *query.BadgerStore (configured
+// through WithAwaiterStore): Badger holds an exclusive lock on its
+// directory for as long as the store is open, so leaving it open would
+// make the next Start on this node fail to acquire it. Outstanding tasks
+// are left unresolved; a caller that expects to Recover them should have
+// already persisted them to the store.
+func (c *QueryManager) Close() error {
+	c.dispatcher.Close()
+	if c.awaiters == nil {
+		return nil
+	}
+	return c.awaiters.Close()
+}
+
+// Subscribe registers clientID's interest in queries matching expr (e.g.
+// `type='presence' AND channel LIKE 'chat/*'`), delivered onto a channel
+// buffered to capacity. dropOldest selects the slow-consumer behavior: drop
+// the oldest buffered delivery (true) or block the publisher (false).
+func (c *QueryManager) Subscribe(clientID, expr string, capacity int, dropOldest bool) (*query.Subscription, error) {
+	return c.bus.Subscribe(clientID, expr, capacity, dropOldest)
+}
+
+// Unsubscribe removes clientID's subscription to expr.
+func (c *QueryManager) Unsubscribe(clientID, expr string) error {
+	return c.bus.Unsubscribe(clientID, expr)
+}
+
+// UnsubscribeAll removes every subscription registered by clientID.
+func (c *QueryManager) UnsubscribeAll(clientID string) {
+	c.bus.UnsubscribeAll(clientID)
+}
+
+// HandleFunc adds a handler invoked for every incoming query matching expr
+// (e.g. `type='presence'`), the same predicate language Subscribe accepts.
+// It is a convenience wrapper around Subscribe for callers that don't need
+// to manage a Subscription directly: it runs handler on a dedicated
+// goroutine as deliveries arrive. Scoping expr to the query types handler
+// actually serves, rather than subscribing to everything, keeps Publish's
+// delivered count meaningful: onRequest relies on it to decide whether a
+// request was claimed or should fall through to a streaming handler.
+func (c *QueryManager) HandleFunc(expr string, handler QueryHandler) error {
+	id := fmt.Sprintf("handler-%d", atomic.AddUint32(&c.legacy, 1))
+	sub, err := c.bus.Subscribe(id, expr, legacyHandlerCapacity, false)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for d := range sub.C() {
+			if response, ok := handler(d.QueryType, d.Payload); ok && d.Reply != nil {
+				d.Reply(response)
+			}
+		}
+	}()
+	return nil
+}
+
+// HandleStreamFunc adds a handler that may emit zero or more response
+// frames for a single request, instead of exactly one. It is tried when no
+// regular handler registered through HandleFunc claims the request.
+func (c *QueryManager) HandleStreamFunc(handler StreamingHandler) {
+	c.streamMu.Lock()
+	c.streamHandlers = append(c.streamHandlers, handler)
+	c.streamMu.Unlock()
 }
 
 // ID returns the unique identifier of the subsriber.
@@ -85,10 +312,17 @@ func (c *QueryManager) Send(ssid subscription.Ssid, channel []byte, payload []by
 		return errors.New("Invalid query received")
 	}
 
-	switch string(channel) {
-	case "response":
-		// We received a response, find the awaiter and forward a message to it
-		return c.onResponse(ssid[2], payload)
+	switch {
+	case string(channel) == "response":
+		// We received a response, end the job's span and forward the
+		// payload to the dispatcher so it can resolve the matching job.
+		c.endJobSpan(ssid[2], len(payload), nil)
+		c.dispatcher.Deliver(ssid[2], payload)
+		return nil
+
+	case strings.HasPrefix(string(channel), "stream/"):
+		// We received a streamed response frame for a RequestStream.
+		return c.onStreamFrame(ssid[2], string(channel), payload)
 
 	default:
 		// We received a request, need to handle that by calling the appropriate handler
@@ -96,86 +330,291 @@ func (c *QueryManager) Send(ssid subscription.Ssid, channel []byte, payload []by
 	}
 }
 
-// onRequest handles an incoming request
-func (c *QueryManager) onResponse(id uint32, payload []byte) error {
-	if awaiter, ok := c.awaiters.Load(id); ok {
-		awaiter.(*QueryAwaiter).receive <- payload
-	}
-	return nil
-}
-
 // onRequest handles an incoming request
 func (c *QueryManager) onRequest(ssid subscription.Ssid, channel string, payload []byte) error {
-	// Get the query and reply node
-	ch := strings.Split(channel, "/")
-	query := ch[0]
+	// Get the query type, reply node and the originator's trace context
+	ch := strings.SplitN(channel, "/", 3)
+	if len(ch) < 2 {
+		return fmt.Errorf("query: malformed channel %q", channel)
+	}
+	queryType := ch[0]
 	reply, err := strconv.ParseInt(ch[1], 10, 64)
 	if err != nil {
 		return err
 	}
 
+	ctx := context.Background()
+	if len(ch) == 3 {
+		ctx = decodeTraceContext(ctx, ch[2])
+	}
+	ctx, span := c.tracer.Start(ctx, "broker.query.onRequest")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("query.type", queryType),
+		attribute.Int64("query.reply_peer", reply),
+	)
+
 	// Get the peer to reply to
 	peer := c.service.cluster.FindPeer(mesh.PeerName(reply))
 
-	// Go through all the handlers and execute the first matching one
-	for _, handle := range c.handlers {
-		if response, ok := handle(query, payload); ok {
-			return peer.Send(ssid, []byte("response"), response)
-		}
+	// Dispatch to every subscription whose query matches; a handler sends
+	// its response by calling Reply, which routes back to the peer.
+	delivered := c.bus.Publish(queryType, []byte(channel), payload, func(response []byte) error {
+		return peer.Send(ssid, []byte("response"), response)
+	})
+	span.SetAttributes(attribute.Int("query.delivered_to", delivered))
+	if delivered > 0 {
+		return nil
+	}
+
+	// No regular handler claimed the request; fall back to a streaming one.
+	streamed, err := c.dispatchStream(queryType, payload, peer, ssid)
+	span.SetAttributes(attribute.Bool("query.streamed", streamed))
+	if streamed {
+		return err
 	}
 
-	return errors.New("No query handler found for " + channel)
+	notFound := errors.New("No query handler found for " + channel)
+	span.SetStatus(codes.Error, notFound.Error())
+	return notFound
 }
 
-// Request issues a cluster-wide request.
-func (c *QueryManager) Request(query string, payload []byte) (*QueryAwaiter, error) {
+// dispatchStream tries every registered StreamingHandler in turn, stopping
+// at the first one that claims the request. It emits each frame the
+// handler produces, followed by an end-of-stream marker.
+func (c *QueryManager) dispatchStream(queryType string, payload []byte, peer mesh.Peer, ssid subscription.Ssid) (bool, error) {
+	c.streamMu.RLock()
+	handlers := c.streamHandlers
+	c.streamMu.RUnlock()
+
+	for _, handle := range handlers {
+		seq := uint32(0)
+		emit := func(frame []byte) error {
+			channel := []byte(fmt.Sprintf("stream/%v/%d", c.service.LocalName(), seq))
+			seq++
+			return peer.Send(ssid, channel, frame)
+		}
+
+		if handle(queryType, payload, emit) {
+			eos := []byte(fmt.Sprintf("stream/%v/eos", c.service.LocalName()))
+			return true, peer.Send(ssid, eos, nil)
+		}
+	}
+	return false, nil
+}
+
+// querySender adapts QueryManager to query.Sender. It is a distinct named
+// type because query.Sender's Send and subscription.Subscriber's Send
+// (implemented directly on QueryManager above) have different signatures
+// and cannot both be named Send on the same type.
+type querySender QueryManager
+
+// Send publishes job's payload to the peer it targets, addressed so the
+// peer's response routes back to the matching job id. It starts a span
+// covering the round trip to peer, as a child of ctx's span (the request
+// that spawned this job) so a trace backend shows the whole fan-out nested
+// under one trace instead of a pile of disconnected single-span ones. The
+// span is ended by endJobSpan: by Send (above) once the response for id
+// arrives, by onJobAbandoned if the attempt times out or its peer errors, or
+// inline below if the peer cannot be found at all.
+func (s *querySender) Send(ctx context.Context, peer mesh.PeerName, id uint32, channel []byte, payload []byte) error {
+	c := (*QueryManager)(s)
+	_, span := c.tracer.Start(ctx, "broker.query.job",
+		trace.WithAttributes(
+			attribute.String("peer.name", peer.String()),
+			attribute.Int64("query.job_id", int64(id)),
+		))
+	c.jobSpans.Store(id, span)
+
+	p := c.service.cluster.FindPeer(peer)
+	if p == nil {
+		err := fmt.Errorf("query: peer %v not found", peer)
+		c.endJobSpan(id, 0, err)
+		return err
+	}
+	return p.Send(subscription.Ssid{idSystem, idQuery, id}, channel, payload)
+}
 
-	// Create an awaiter
-	// TODO: replace the max with the total number of cluster nodes
-	awaiter := &QueryAwaiter{
-		id:      atomic.AddUint32(&c.next, 1),
-		receive: make(chan []byte),
-		maximum: c.service.NumPeers(),
-		manager: c,
+// endJobSpan closes the span started in querySender.Send for job id, if
+// still open, recording the response size and any error.
+func (c *QueryManager) endJobSpan(id uint32, responseSize int, err error) {
+	v, ok := c.jobSpans.LoadAndDelete(id)
+	if !ok {
+		return
+	}
+	span := v.(trace.Span)
+	span.SetAttributes(attribute.Int("query.response_size", responseSize))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
 	}
+	span.End()
+}
 
-	// Store an awaiter
-	c.awaiters.Store(awaiter.id, awaiter)
+// Request issues a cluster-wide request, fanning it out to every connected
+// peer through the work dispatcher and gathering the responses.
+func (c *QueryManager) Request(ctx context.Context, queryType string, payload []byte) (*QueryAwaiter, error) {
+	peers := c.service.cluster.Peers()
+	ctx, span := c.tracer.Start(ctx, "broker.query.request")
+	span.SetAttributes(
+		attribute.String("query.type", queryType),
+		attribute.Int("query.expected_responders", len(peers)),
+	)
 
-	// Prepare a channel with the reply-to address
-	channel := fmt.Sprintf("%v/%v", query, c.service.LocalName())
+	// Prepare a channel with the reply-to address and the trace context so
+	// that remote peers can link their onRequest span back to this one.
+	channel := []byte(fmt.Sprintf("%v/%v/%v", queryType, c.service.LocalName(), encodeTraceContext(ctx)))
 
-	// Publish the query as a message
-	c.service.publish(subscription.Ssid{idSystem, idQuery, awaiter.id}, []byte(channel), payload)
-	return awaiter, nil
+	task := c.dispatcher.Dispatch(ctx, channel, peers, payload)
+	return &QueryAwaiter{task: task, span: span}, nil
 }
 
-// QueryAwaiter represents an asynchronously awaiting response channel.
+// QueryAwaiter represents an asynchronously awaiting response channel,
+// backed by the dispatcher's per-job Results stream. For a caller that
+// only needs every response buffered into a slice, it serves the same
+// role RequestStream's channel does for a caller that wants to consume
+// frames incrementally.
 type QueryAwaiter struct {
-	id      uint32        // The identifier of the query.
-	maximum int           // The maximum number of responses to wait for.
-	receive chan []byte   // The receive channel to use.
-	manager *QueryManager // The query manager used.
+	task *query.Task // The task tracking this query's jobs.
+	span trace.Span  // The span covering the request, ended once Gather returns.
 }
 
-// Gather awaits for the responses to be received, blocking until we're done.
-func (a *QueryAwaiter) Gather(timeout time.Duration) (r [][]byte) {
-	defer func() { a.manager.awaiters.Delete(a.id) }()
-	r = make([][]byte, 0, 4)
-	t := time.After(timeout)
-	c := a.maximum
+// Response represents a single streamed frame of a RequestStream query.
+type Response struct {
+	Peer    mesh.PeerName // The peer that emitted this frame.
+	Payload []byte        // The frame's payload.
+	Seq     uint32        // The frame's sequence number within its peer's stream.
+}
 
+// RequestStream issues a cluster-wide request that may draw more than one
+// response frame per peer, handled by a StreamingHandler on the remote
+// side. Frames stream onto the returned channel as they arrive; the
+// channel is closed once every peer has signalled end-of-stream. Once ctx
+// is cancelled, frames still in flight are dropped rather than delivered,
+// so callers should keep consuming (or stop, selecting on ctx.Done()) as
+// fits their use case.
+func (c *QueryManager) RequestStream(ctx context.Context, queryType string, payload []byte) (<-chan Response, error) {
+	id := atomic.AddUint32(&c.streamNext, 1)
+	owed := make(map[mesh.PeerName]bool)
+	for _, peer := range c.service.cluster.Peers() {
+		owed[peer] = true
+	}
+	state := &streamState{ch: make(chan Response, streamBufferSize), ctx: ctx, owed: owed}
+	c.streams.Store(id, state)
+
+	if len(owed) == 0 {
+		// No peer is expected to answer, so no "eos" will ever arrive.
+		c.streams.Delete(id)
+		close(state.ch)
+		return state.ch, nil
+	}
+
+	channel := []byte(fmt.Sprintf("%v/%v/%v", queryType, c.service.LocalName(), encodeTraceContext(ctx)))
+	if err := c.service.publish(subscription.Ssid{idSystem, idQuery, id}, channel, payload); err != nil {
+		c.streams.Delete(id)
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		c.streams.Delete(id)
+	}()
+	return state.ch, nil
+}
+
+// onStreamFrame routes an incoming streamed response frame to the
+// RequestStream awaiting id. A peer's "eos" marker only retires that peer;
+// the stream's channel is closed once every peer fanned out to by the
+// originating Request has sent its own. Frames for an id with no (or no
+// longer) a waiting stream are silently dropped.
+func (c *QueryManager) onStreamFrame(id uint32, channel string, payload []byte) error {
+	v, ok := c.streams.Load(id)
+	if !ok {
+		return nil
+	}
+	state := v.(*streamState)
+
+	parts := strings.SplitN(channel, "/", 3)
+	if len(parts) != 3 {
+		return fmt.Errorf("query: malformed stream frame %q", channel)
+	}
+	rawPeer, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	peer := mesh.PeerName(rawPeer)
+
+	if parts[2] == "eos" {
+		if state.eosFrom(peer) {
+			if _, ok := c.streams.LoadAndDelete(id); ok {
+				close(state.ch)
+			}
+		}
+		return nil
+	}
+
+	seq, err := strconv.ParseUint(parts[2], 10, 32)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case state.ch <- Response{Peer: peer, Payload: payload, Seq: uint32(seq)}:
+	case <-state.ctx.Done():
+	}
+	return nil
+}
+
+// Gather awaits for the responses to be received, blocking until the task
+// completes, the context is cancelled, or no response arrives within
+// timeout of the previous one.
+func (a *QueryAwaiter) Gather(ctx context.Context, timeout time.Duration) (r [][]byte) {
+	defer a.span.End()
+	r = make([][]byte, 0, 4)
 	for {
+		t := time.NewTimer(timeout)
 		select {
-		case msg := <-a.receive:
-			r = append(r, msg)
-			c-- // Decrement the counter
-			if c == 0 {
-				return // We got all the responses we needed
+		case resp, ok := <-a.task.Results:
+			t.Stop()
+			if !ok {
+				a.span.SetAttributes(attribute.Int("query.responses", len(r)))
+				return // Every job has been resolved.
+			}
+			if resp.Err == nil {
+				r = append(r, resp.Payload)
+				a.span.AddEvent("response received", trace.WithAttributes(
+					attribute.String("peer.name", resp.Peer.String()),
+				))
 			}
 
-		case <-t:
-			return // We timed out
+		case <-ctx.Done():
+			t.Stop()
+			a.span.SetStatus(codes.Error, "cancelled")
+			a.span.SetAttributes(attribute.Int("query.responses", len(r)))
+			return // The caller cancelled the gather.
+
+		case <-t.C:
+			a.span.SetAttributes(attribute.Int("query.responses", len(r)))
+			return // No response arrived within the per-response deadline.
 		}
 	}
 }
+
+// encodeTraceContext base64-encodes the traceparent header for the span in
+// ctx so it can be appended, without colliding with the "/" delimiters
+// already used in a reply-to channel.
+func encodeTraceContext(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return base64.RawURLEncoding.EncodeToString([]byte(carrier.Get("traceparent")))
+}
+
+// decodeTraceContext reverses encodeTraceContext, returning ctx unchanged
+// if seg cannot be decoded into a valid traceparent.
+func decodeTraceContext(ctx context.Context, seg string) context.Context {
+	raw, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return ctx
+	}
+	carrier := propagation.MapCarrier{"traceparent": string(raw)}
+	return propagation.TraceContext{}.Extract(ctx, carrier)
+}
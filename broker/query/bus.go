@@ -0,0 +1,247 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package query
+
+import (
+	"errors"
+	"sync"
+)
+
+// errNotSubscribed is returned by Unsubscribe when the client has no
+// matching subscription.
+var errNotSubscribed = errors.New("query: not subscribed")
+
+// Delivery is a single incoming request handed to a matching subscription.
+type Delivery struct {
+	QueryType string             // The type of the query.
+	Channel   []byte             // The raw channel the request arrived on.
+	Payload   []byte             // The request payload.
+	Reply     func([]byte) error // Sends a response back to the requester, nil if unaddressable.
+}
+
+// Subscription is a single client's registration against a Query, with a
+// buffered channel of matching deliveries.
+type Subscription struct {
+	ClientID   string
+	Query      *Query
+	ch         chan Delivery
+	dropOldest bool // When true, a full channel drops its oldest delivery instead of blocking the publisher.
+
+	// closeMu guards closed and ch's closedness against a concurrent
+	// deliver: a deliver holds closeMu for reading while it sends, and
+	// close (Unsubscribe/UnsubscribeAll) takes it for writing before
+	// closing ch, so a blocking send can never race a close of the same
+	// channel.
+	closeMu sync.RWMutex
+	closed  bool
+}
+
+// close closes sub's channel, guarding against a concurrent deliver. It is a
+// no-op if sub was already closed.
+func (s *Subscription) close() {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
+	}
+}
+
+// C returns the channel deliveries matching this subscription arrive on.
+// It is closed once the subscription is removed via Unsubscribe or
+// UnsubscribeAll.
+func (s *Subscription) C() <-chan Delivery {
+	return s.ch
+}
+
+// Bus is a typed pub/sub dispatcher for incoming queries: handlers
+// subscribe against a compiled Query rather than being polled linearly,
+// and incoming requests are dispatched only to the subscriptions whose
+// predicate actually matches. It is safe for concurrent use.
+type Bus struct {
+	mu     sync.RWMutex
+	byType map[string][]*Subscription // Subscriptions indexed by an exact `type=` clause.
+	open   []*Subscription            // Subscriptions with no `type=` clause, checked against every publish.
+
+	// byClient maps a client id to its subscriptions, keyed by query
+	// expression, so Unsubscribe/UnsubscribeAll can find and drop them.
+	byClient map[string]map[string]*Subscription
+}
+
+// NewBus creates an empty query bus.
+func NewBus() *Bus {
+	return &Bus{
+		byType:   make(map[string][]*Subscription),
+		byClient: make(map[string]map[string]*Subscription),
+	}
+}
+
+// Subscribe registers clientID's interest in queries matching expr. The
+// subscription's channel buffers up to capacity deliveries; once full, a
+// slow consumer either has its oldest delivery dropped (dropOldest=true)
+// or blocks the publisher (dropOldest=false).
+func (b *Bus) Subscribe(clientID, expr string, capacity int, dropOldest bool) (*Subscription, error) {
+	q, err := ParseQuery(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &Subscription{
+		ClientID:   clientID,
+		Query:      q,
+		ch:         make(chan Delivery, capacity),
+		dropOldest: dropOldest,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subs, ok := b.byClient[clientID]
+	if !ok {
+		subs = make(map[string]*Subscription)
+		b.byClient[clientID] = subs
+	}
+	if old, ok := subs[expr]; ok {
+		b.remove(old)
+		old.close()
+	}
+
+	if t, ok := q.typeValue(); ok {
+		b.byType[t] = append(b.byType[t], sub)
+	} else {
+		b.open = append(b.open, sub)
+	}
+	subs[expr] = sub
+	return sub, nil
+}
+
+// Unsubscribe removes clientID's subscription to expr, closing its channel.
+func (b *Bus) Unsubscribe(clientID, expr string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subs, ok := b.byClient[clientID]
+	if !ok {
+		return errNotSubscribed
+	}
+	sub, ok := subs[expr]
+	if !ok {
+		return errNotSubscribed
+	}
+
+	delete(subs, expr)
+	if len(subs) == 0 {
+		delete(b.byClient, clientID)
+	}
+	b.remove(sub)
+	sub.close()
+	return nil
+}
+
+// UnsubscribeAll removes every subscription registered by clientID, closing
+// each of their channels.
+func (b *Bus) UnsubscribeAll(clientID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, sub := range b.byClient[clientID] {
+		b.remove(sub)
+		sub.close()
+	}
+	delete(b.byClient, clientID)
+}
+
+// remove drops sub from whichever index it was placed in. Callers must
+// hold b.mu.
+func (b *Bus) remove(sub *Subscription) {
+	if t, ok := sub.Query.typeValue(); ok {
+		b.byType[t] = removeSub(b.byType[t], sub)
+		return
+	}
+	b.open = removeSub(b.open, sub)
+}
+
+// Publish dispatches a request to every subscription whose Query matches,
+// attaching reply as the means for a subscriber to respond. It returns the
+// number of subscriptions the request was delivered to. Matching is done
+// under b's lock, but the deliveries themselves (which may block, for a
+// subscription with dropOldest=false) happen after it is released, so a
+// single stalled subscriber cannot wedge Subscribe/Unsubscribe or other
+// Publish calls behind it.
+func (b *Bus) Publish(queryType string, channel []byte, payload []byte, reply func([]byte) error) int {
+	attrs := map[string]string{"type": queryType, "channel": string(channel)}
+	delivery := Delivery{QueryType: queryType, Channel: channel, Payload: payload, Reply: reply}
+
+	b.mu.RLock()
+	matched := make([]*Subscription, 0, len(b.byType[queryType])+len(b.open))
+	for _, sub := range b.byType[queryType] {
+		if sub.Query.Matches(attrs) {
+			matched = append(matched, sub)
+		}
+	}
+	for _, sub := range b.open {
+		if sub.Query.Matches(attrs) {
+			matched = append(matched, sub)
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, sub := range matched {
+		deliver(sub, delivery)
+	}
+	return len(matched)
+}
+
+// deliver pushes d onto sub's channel, honouring its slow-consumer policy.
+// It holds sub's own closeMu for reading for the duration of the send, so a
+// concurrent Unsubscribe closing sub.ch cannot race the send into a panic;
+// that lock is scoped to this one subscription, so it never blocks delivery
+// to any other subscriber.
+func deliver(sub *Subscription, d Delivery) {
+	sub.closeMu.RLock()
+	defer sub.closeMu.RUnlock()
+	if sub.closed {
+		return
+	}
+
+	if !sub.dropOldest {
+		sub.ch <- d
+		return
+	}
+
+	select {
+	case sub.ch <- d:
+	default:
+		select {
+		case <-sub.ch:
+		default:
+		}
+		select {
+		case sub.ch <- d:
+		default:
+		}
+	}
+}
+
+// removeSub returns a copy of subs with sub removed.
+func removeSub(subs []*Subscription, sub *Subscription) []*Subscription {
+	out := make([]*Subscription, 0, len(subs))
+	for _, s := range subs {
+		if s != sub {
+			out = append(out, s)
+		}
+	}
+	return out
+}
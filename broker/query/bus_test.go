@@ -0,0 +1,149 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package query
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBus_PublishDeliversOnlyToMatchingSubscriptions(t *testing.T) {
+	b := NewBus()
+	presence, err := b.Subscribe("client-a", "type='presence'", 1, false)
+	require.NoError(t, err)
+	everything, err := b.Subscribe("client-b", "", 1, false)
+	require.NoError(t, err)
+
+	delivered := b.Publish("presence", []byte("chat/room"), []byte("hello"), nil)
+	assert.Equal(t, 2, delivered)
+
+	select {
+	case d := <-presence.C():
+		assert.Equal(t, "presence", d.QueryType)
+	default:
+		t.Fatal("expected presence subscription to receive the delivery")
+	}
+	select {
+	case d := <-everything.C():
+		assert.Equal(t, "presence", d.QueryType)
+	default:
+		t.Fatal("expected catch-all subscription to receive the delivery")
+	}
+
+	delivered = b.Publish("history", nil, nil, nil)
+	assert.Equal(t, 1, delivered, "only the catch-all subscription should match")
+}
+
+func TestBus_UnsubscribeClosesChannelAndStopsDelivery(t *testing.T) {
+	b := NewBus()
+	sub, err := b.Subscribe("client-a", "type='presence'", 1, false)
+	require.NoError(t, err)
+
+	require.NoError(t, b.Unsubscribe("client-a", "type='presence'"))
+	_, open := <-sub.C()
+	assert.False(t, open, "channel should be closed once unsubscribed")
+
+	assert.Equal(t, 0, b.Publish("presence", nil, nil, nil))
+}
+
+func TestBus_UnsubscribeUnknownReturnsError(t *testing.T) {
+	b := NewBus()
+	assert.Equal(t, errNotSubscribed, b.Unsubscribe("nobody", "type='presence'"))
+
+	_, err := b.Subscribe("client-a", "type='presence'", 1, false)
+	require.NoError(t, err)
+	assert.Equal(t, errNotSubscribed, b.Unsubscribe("client-a", "type='other'"))
+}
+
+func TestBus_UnsubscribeAllRemovesEveryClientSubscription(t *testing.T) {
+	b := NewBus()
+	sub1, err := b.Subscribe("client-a", "type='presence'", 1, false)
+	require.NoError(t, err)
+	sub2, err := b.Subscribe("client-a", "type='history'", 1, false)
+	require.NoError(t, err)
+
+	b.UnsubscribeAll("client-a")
+
+	_, open := <-sub1.C()
+	assert.False(t, open)
+	_, open = <-sub2.C()
+	assert.False(t, open)
+	assert.Equal(t, 0, b.Publish("presence", nil, nil, nil))
+}
+
+func TestBus_ResubscribeSameExprClosesThePreviousSubscription(t *testing.T) {
+	b := NewBus()
+	first, err := b.Subscribe("client-a", "type='presence'", 1, false)
+	require.NoError(t, err)
+
+	second, err := b.Subscribe("client-a", "type='presence'", 1, false)
+	require.NoError(t, err)
+
+	_, open := <-first.C()
+	assert.False(t, open, "the orphaned subscription should have been closed by the resubscribe")
+
+	delivered := b.Publish("presence", nil, []byte("hello"), nil)
+	assert.Equal(t, 1, delivered, "only the latest subscription should still be registered")
+	select {
+	case d := <-second.C():
+		assert.Equal(t, []byte("hello"), d.Payload)
+	default:
+		t.Fatal("expected the latest subscription to receive the delivery")
+	}
+
+	require.NoError(t, b.Unsubscribe("client-a", "type='presence'"))
+}
+
+func TestBus_DropOldestDropsInsteadOfBlocking(t *testing.T) {
+	b := NewBus()
+	sub, err := b.Subscribe("client-a", "type='presence'", 1, true)
+	require.NoError(t, err)
+
+	b.Publish("presence", nil, []byte("first"), nil)
+	b.Publish("presence", nil, []byte("second"), nil)
+
+	select {
+	case d := <-sub.C():
+		assert.Equal(t, []byte("second"), d.Payload, "the oldest buffered delivery should have been dropped")
+	case <-time.After(time.Second):
+		t.Fatal("dropOldest subscription should never block a publish")
+	}
+}
+
+func TestBus_PublishBlocksASlowNonDropOldestSubscriber(t *testing.T) {
+	b := NewBus()
+	sub, err := b.Subscribe("slow", "type='presence'", 1, false)
+	require.NoError(t, err)
+
+	b.Publish("presence", nil, []byte("first"), nil)
+
+	done := make(chan struct{})
+	go func() {
+		b.Publish("presence", nil, []byte("second"), nil) // blocks: slow's channel is already full.
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("second publish should still be blocked on the saturated subscriber")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-sub.C() // draining the first delivery unblocks the publish above.
+	<-done
+}
@@ -0,0 +1,366 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package query
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// maxAttempts bounds how many different peers, counting the first, a single
+// job will be sent to before it is reported as failed.
+const maxAttempts = 3
+
+// Sender delivers a job's payload to a single peer under channel. id
+// identifies the job so that the transport can address the peer's
+// response back to it. ctx carries the trace of the request the job
+// belongs to, so an implementation that records a span for the attempt can
+// start it as a child of ctx's span instead of a disconnected root. It is
+// implemented by the broker's cluster transport.
+type Sender interface {
+	Send(ctx context.Context, peer mesh.PeerName, id uint32, channel []byte, payload []byte) error
+}
+
+// WorkManager dispatches jobs to peers honouring a PeerRanking and a
+// per-peer in-flight cap. A job that times out or comes back with an error
+// is re-queued against a different, highest-ranked peer until it succeeds
+// or maxAttempts is reached.
+type WorkManager struct {
+	sender     Sender
+	ranking    *PeerRanking
+	timeout    time.Duration
+	store      AwaiterStore
+	onStoreErr func(id uint32, err error) // Notified of a failed store write, if set.
+	onAbandon  func(id uint32)            // Notified when a dispatch attempt is abandoned (timeout or error), if set.
+
+	mu      sync.Mutex
+	pending map[uint32]*pendingJob // jobs currently awaiting a response, keyed by job id.
+	queue   []*queuedJob           // jobs waiting for a non-saturated candidate, oldest first.
+	next    uint32                 // the next available job identifier.
+	quit    chan struct{}
+}
+
+// pendingJob tracks a dispatched job while it awaits a response.
+type pendingJob struct {
+	job      *Job
+	started  time.Time
+	deadline *time.Timer
+}
+
+// queuedJob tracks a job that could not be dispatched because every one of
+// its candidates was already at its in-flight cap, waiting to be retried
+// once one of them frees a slot.
+type queuedJob struct {
+	job        *Job
+	candidates []mesh.PeerName
+}
+
+// NewWorkManager creates a work manager which dispatches jobs through the
+// given sender, ranking peers with ranking, retrying a job against another
+// peer once an attempt has been outstanding for longer than timeout, and
+// persisting outstanding tasks to store so Recover can reopen them after a
+// restart.
+func NewWorkManager(sender Sender, ranking *PeerRanking, timeout time.Duration, store AwaiterStore) *WorkManager {
+	return &WorkManager{
+		sender:  sender,
+		ranking: ranking,
+		timeout: timeout,
+		store:   store,
+		pending: make(map[uint32]*pendingJob),
+		quit:    make(chan struct{}),
+	}
+}
+
+// OnStoreError registers fn to be called whenever a write to the
+// WorkManager's AwaiterStore fails, so a caller can surface a persistence
+// failure (e.g. onto a trace span) instead of it passing silently. Only one
+// callback is kept; a later call replaces an earlier one. It is optional:
+// with no callback registered, store errors are dropped, matching a
+// WorkManager's prior behaviour before persistence was introduced.
+func (w *WorkManager) OnStoreError(fn func(id uint32, err error)) {
+	w.onStoreErr = fn
+}
+
+// OnAbandon registers fn to be called with a dispatch attempt's id whenever
+// it is abandoned, whether because it timed out or its peer reported an
+// error, just before a replacement attempt is dispatched (or the job is
+// given up on). This lets a caller end per-attempt bookkeeping keyed by that
+// id, such as a trace span, before a new id takes its place. Only one
+// callback is kept; a later call replaces an earlier one. It is optional:
+// with no callback registered, an abandoned attempt's id is simply dropped.
+func (w *WorkManager) OnAbandon(fn func(id uint32)) {
+	w.onAbandon = fn
+}
+
+// reportAbandon forwards an abandoned attempt's id to onAbandon, if one is
+// registered.
+func (w *WorkManager) reportAbandon(id uint32) {
+	if w.onAbandon != nil {
+		w.onAbandon(id)
+	}
+}
+
+// Submit persists task to the AwaiterStore and dispatches every one of its
+// jobs to its highest-ranked eligible peer. A job whose only candidate is
+// currently saturated is queued instead of failed outright, and retried the
+// next time a slot on one of its candidates frees up (see release).
+func (w *WorkManager) Submit(task *Task) {
+	if len(task.Jobs) > 0 {
+		if err := w.store.Put(AwaiterRecord{
+			ID:            task.ID,
+			Channel:       task.Jobs[0].Channel,
+			Payload:       task.Jobs[0].Payload,
+			IssuedAt:      time.Now(),
+			ExpectedPeers: task.peers,
+		}); err != nil {
+			w.reportStoreErr(task.ID, err)
+		}
+	}
+	for _, job := range task.Jobs {
+		w.dispatch(job, []mesh.PeerName{job.Peer})
+	}
+}
+
+// reportStoreErr forwards a failed store write to onStoreErr, if one is
+// registered.
+func (w *WorkManager) reportStoreErr(id uint32, err error) {
+	if w.onStoreErr != nil {
+		w.onStoreErr(id, err)
+	}
+}
+
+// Recover reopens every task found in the AwaiterStore: responses already
+// buffered before the restart are replayed onto the resumed Task's Results
+// channel, and a fresh job is dispatched to every peer that has not yet
+// answered. It is safe to call at most once, before any new task has been
+// submitted, since it does not otherwise reserve the task ids it reuses.
+func (w *WorkManager) Recover() ([]*Task, error) {
+	records, err := w.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := make([]*Task, 0, len(records))
+	for _, rec := range records {
+		tasks = append(tasks, w.resume(rec))
+	}
+	return tasks, nil
+}
+
+// resume rebuilds a Task from a persisted record, replaying any response
+// already received and re-dispatching a job for every peer still owed one.
+func (w *WorkManager) resume(rec AwaiterRecord) *Task {
+	task := &Task{
+		ID: rec.ID,
+		// A resumed task has no live request span to attach to; its jobs'
+		// spans start as their own roots, same as before tracing existed.
+		ctx:     context.Background(),
+		Results: make(chan Response, len(rec.ExpectedPeers)),
+		peers:   rec.ExpectedPeers,
+		pending: int32(len(rec.ExpectedPeers) - len(rec.ReceivedFrom)),
+	}
+
+	answered := make([]mesh.PeerName, 0, len(rec.ReceivedFrom))
+	for peer, payload := range rec.ReceivedFrom {
+		task.Results <- Response{Peer: peer, Payload: payload}
+		answered = append(answered, peer)
+	}
+
+	// A fully answered task is closed here; otherwise resolve closes it once
+	// the last re-dispatched job resolves, which may happen inside dispatch.
+	if task.pending == 0 {
+		close(task.Results)
+		if err := w.store.Delete(task.ID); err != nil {
+			w.reportStoreErr(task.ID, err)
+		}
+		return task
+	}
+
+	outstanding := exclude(rec.ExpectedPeers, answered)
+	for _, peer := range outstanding {
+		job := &Job{Peer: peer, Channel: rec.Channel, Payload: rec.Payload, task: task}
+		task.Jobs = append(task.Jobs, job)
+		w.dispatch(job, []mesh.PeerName{peer})
+	}
+	return task
+}
+
+// dispatch sends a job to the best-ranked of candidates and arms its
+// timeout. If no candidate is currently eligible, the job is queued instead,
+// to be retried by release once one of candidates frees an in-flight slot.
+func (w *WorkManager) dispatch(job *Job, candidates []mesh.PeerName) {
+	peer, ok := w.ranking.Best(candidates)
+	if !ok {
+		w.mu.Lock()
+		w.queue = append(w.queue, &queuedJob{job: job, candidates: candidates})
+		w.mu.Unlock()
+		return
+	}
+	job.Peer = peer
+	job.tried = append(job.tried, peer)
+
+	id := atomic.AddUint32(&w.next, 1)
+	pj := &pendingJob{job: job, started: time.Now()}
+	pj.deadline = time.AfterFunc(w.timeout, func() { w.onTimeout(id) })
+
+	w.mu.Lock()
+	w.pending[id] = pj
+	w.mu.Unlock()
+
+	if err := w.sender.Send(job.task.ctx, peer, id, job.Channel, job.Payload); err != nil {
+		w.onError(id, err)
+	}
+}
+
+// release is called whenever a job's resolution frees an in-flight slot on
+// one of its candidates (Success, Timeout or Error), and retries the
+// longest-queued job. If that job's candidates are still all saturated, it
+// re-queues itself, so a single release attempts at most one dispatch.
+func (w *WorkManager) release() {
+	w.mu.Lock()
+	if len(w.queue) == 0 {
+		w.mu.Unlock()
+		return
+	}
+	qj := w.queue[0]
+	w.queue = w.queue[1:]
+	w.mu.Unlock()
+
+	w.dispatch(qj.job, qj.candidates)
+}
+
+// Deliver feeds a response received for job id back into the work
+// manager, completing the job and scoring its peer. It is a no-op if the
+// job already timed out or was delivered.
+func (w *WorkManager) Deliver(id uint32, payload []byte) {
+	w.onSuccess(id, payload)
+}
+
+// Close stops the work manager, cancelling every pending job's deadline
+// timer. Outstanding and queued tasks are left unresolved.
+func (w *WorkManager) Close() {
+	close(w.quit)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for id, pj := range w.pending {
+		pj.deadline.Stop()
+		delete(w.pending, id)
+	}
+	w.queue = nil
+}
+
+// onTimeout re-queues a job that did not receive a response in time.
+func (w *WorkManager) onTimeout(id uint32) {
+	pj, ok := w.takePending(id)
+	if !ok {
+		return
+	}
+	w.ranking.Timeout(pj.job.Peer)
+	w.release()
+	w.retry(id, pj)
+}
+
+// onError re-queues a job whose peer reported an error.
+func (w *WorkManager) onError(id uint32, _ error) {
+	pj, ok := w.takePending(id)
+	if !ok {
+		return
+	}
+	w.ranking.Error(pj.job.Peer)
+	w.release()
+	w.retry(id, pj)
+}
+
+// onSuccess completes a job and delivers its response onto the task's
+// Results channel.
+func (w *WorkManager) onSuccess(id uint32, payload []byte) {
+	pj, ok := w.takePending(id)
+	if !ok {
+		return
+	}
+	w.ranking.Success(pj.job.Peer, time.Since(pj.started))
+	w.release()
+	if err := w.store.MarkReceived(pj.job.task.ID, pj.job.Peer, payload); err != nil {
+		w.reportStoreErr(pj.job.task.ID, err)
+	}
+	w.resolve(pj.job, Response{Peer: pj.job.Peer, Payload: payload})
+}
+
+// retry re-dispatches a job to a different peer, or fails it once
+// maxAttempts is reached or its task has no untried peers left. id is the
+// abandoned attempt's id, reported via onAbandon before the replacement (if
+// any) is dispatched under a new one.
+func (w *WorkManager) retry(id uint32, pj *pendingJob) {
+	w.reportAbandon(id)
+
+	job := pj.job
+	remaining := exclude(job.task.peers, job.tried)
+	if len(job.tried) >= maxAttempts || len(remaining) == 0 {
+		w.resolve(job, Response{Peer: job.Peer, Err: errExhausted})
+		return
+	}
+	w.dispatch(job, remaining)
+}
+
+// resolve delivers a job's final response and closes the task's Results
+// channel once every job in the task has been resolved.
+func (w *WorkManager) resolve(job *Job, resp Response) {
+	task := job.task
+	task.Results <- resp
+	if atomic.AddInt32(&task.pending, -1) == 0 {
+		close(task.Results)
+		if err := w.store.Delete(task.ID); err != nil {
+			w.reportStoreErr(task.ID, err)
+		}
+	}
+}
+
+// takePending removes and returns a pending job, stopping its deadline
+// timer. It returns false if the job was already resolved (e.g. the
+// timeout and a late success raced).
+func (w *WorkManager) takePending(id uint32) (*pendingJob, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	pj, ok := w.pending[id]
+	if !ok {
+		return nil, false
+	}
+	delete(w.pending, id)
+	pj.deadline.Stop()
+	return pj, true
+}
+
+// exclude returns the peers of all that do not appear in tried.
+func exclude(all, tried []mesh.PeerName) []mesh.PeerName {
+	out := make([]mesh.PeerName, 0, len(all))
+	for _, p := range all {
+		skip := false
+		for _, t := range tried {
+			if p == t {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,106 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package query
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Dispatcher is the entry point of the query subsystem: it fans a single
+// logical query out into a Task and hands its jobs to a WorkManager for
+// scoring, retries and backpressure.
+type Dispatcher struct {
+	manager *WorkManager
+	next    uint32
+}
+
+// NewDispatcher creates a dispatcher which sends jobs through sender, caps
+// in-flight jobs per peer at maxInFlight and retries a job against another
+// peer once an attempt has gone unanswered for timeout.
+// Outstanding tasks are persisted to store so a later Recover call can
+// reopen them; a nil store defaults to an in-memory one, keeping a
+// Dispatcher constructed without persistence behaving exactly as before.
+func NewDispatcher(sender Sender, maxInFlight int, timeout time.Duration, store AwaiterStore) *Dispatcher {
+	if store == nil {
+		store = NewMemStore()
+	}
+	ranking := NewPeerRanking(maxInFlight)
+	return &Dispatcher{
+		manager: NewWorkManager(sender, ranking, timeout, store),
+	}
+}
+
+// Dispatch fans out a query to every candidate peer and returns the Task
+// tracking the resulting batch of jobs. channel is the reply-to address
+// each job is published under. Responses stream onto Task.Results as they
+// arrive; the channel closes once every job is resolved. ctx is carried
+// onto every job dispatched for the task, so a Sender can start each job's
+// span as a child of whatever span ctx carries.
+func (d *Dispatcher) Dispatch(ctx context.Context, channel []byte, peers []mesh.PeerName, payload []byte) *Task {
+	task := newTask(ctx, atomic.AddUint32(&d.next, 1), channel, peers, payload)
+	d.manager.Submit(task)
+	return task
+}
+
+// Deliver feeds a response received for job id back into the dispatcher.
+func (d *Dispatcher) Deliver(id uint32, payload []byte) {
+	d.manager.Deliver(id, payload)
+}
+
+// OnStoreError registers fn to be called whenever a write to the
+// dispatcher's AwaiterStore fails, so a caller can surface a persistence
+// failure instead of it passing silently.
+func (d *Dispatcher) OnStoreError(fn func(id uint32, err error)) {
+	d.manager.OnStoreError(fn)
+}
+
+// OnAbandon registers fn to be called with a dispatch attempt's id whenever
+// it is abandoned (timeout or error), just before a replacement attempt is
+// dispatched under a new id. This lets a caller end per-attempt bookkeeping
+// keyed by that id, such as a trace span, before a new id takes its place.
+func (d *Dispatcher) OnAbandon(fn func(id uint32)) {
+	d.manager.OnAbandon(fn)
+}
+
+// Recover reopens every task still outstanding in the dispatcher's
+// AwaiterStore, so that in-flight responses buffered before a broker
+// restart are replayed and unanswered peers are re-dispatched. It should be
+// called once, before the dispatcher issues any new Dispatch calls, so
+// that the task ids it reuses cannot collide with freshly minted ones.
+func (d *Dispatcher) Recover() ([]*Task, error) {
+	tasks, err := d.manager.Recover()
+	if err != nil {
+		return nil, err
+	}
+	for _, task := range tasks {
+		for {
+			cur := atomic.LoadUint32(&d.next)
+			if task.ID <= cur || atomic.CompareAndSwapUint32(&d.next, cur, task.ID) {
+				break
+			}
+		}
+	}
+	return tasks, nil
+}
+
+// Close releases the dispatcher's resources. Outstanding tasks are left
+// unresolved.
+func (d *Dispatcher) Close() {
+	d.manager.Close()
+}
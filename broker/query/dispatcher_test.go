@@ -0,0 +1,259 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package query
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+// fakeSender lets a test script which peers succeed, error or are left to
+// time out, and records every id it was asked to send.
+type fakeSender struct {
+	mu      sync.Mutex
+	results map[mesh.PeerName]error // nil entry means "succeed", a non-nil entry means "fail with this error".
+	sent    []uint32
+	manager *WorkManager // Set after NewWorkManager, so Send can simulate an immediate peer reply.
+}
+
+func (s *fakeSender) Send(_ context.Context, peer mesh.PeerName, id uint32, _ []byte, _ []byte) error {
+	s.mu.Lock()
+	s.sent = append(s.sent, id)
+	err, ok := s.results[peer]
+	s.mu.Unlock()
+
+	if !ok {
+		return nil // left pending, e.g. to simulate a timeout.
+	}
+	if err != nil {
+		return err
+	}
+	s.manager.Deliver(id, []byte("ok"))
+	return nil
+}
+
+// sentIDs returns a snapshot of every job id the sender was asked to send,
+// in the order Send was called.
+func (s *fakeSender) sentIDs() []uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint32(nil), s.sent...)
+}
+
+type ctxKey struct{}
+
+func TestDispatcher_DispatchThreadsItsContextThroughToSend(t *testing.T) {
+	a := mesh.PeerName(1)
+	var gotCtx context.Context
+	sender := sendFunc(func(ctx context.Context, _ mesh.PeerName, _ uint32, _ []byte, _ []byte) error {
+		gotCtx = ctx
+		return nil
+	})
+
+	d := NewDispatcher(sender, 1, time.Minute, NewMemStore())
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request-span")
+
+	d.Dispatch(ctx, []byte("reply-to"), []mesh.PeerName{a}, []byte("payload"))
+
+	require.NotNil(t, gotCtx, "Send should have been called")
+	assert.Equal(t, "request-span", gotCtx.Value(ctxKey{}), "Send should receive the context Dispatch was called with")
+}
+
+// sendFunc adapts a plain function to the Sender interface.
+type sendFunc func(ctx context.Context, peer mesh.PeerName, id uint32, channel []byte, payload []byte) error
+
+func (f sendFunc) Send(ctx context.Context, peer mesh.PeerName, id uint32, channel []byte, payload []byte) error {
+	return f(ctx, peer, id, channel, payload)
+}
+
+func TestWorkManager_RetriesAgainstADifferentPeerOnError(t *testing.T) {
+	a, b := mesh.PeerName(1), mesh.PeerName(2)
+	sender := &fakeSender{results: map[mesh.PeerName]error{
+		a: assert.AnError,
+		b: nil,
+	}}
+	manager := NewWorkManager(sender, NewPeerRanking(1), time.Minute, NewMemStore())
+	sender.manager = manager
+
+	task := newTask(context.Background(), 1, []byte("reply-to"), []mesh.PeerName{a, b}, []byte("payload"))
+	manager.Submit(task)
+
+	select {
+	case resp := <-task.Results:
+		assert.Equal(t, b, resp.Peer)
+		assert.NoError(t, resp.Err)
+	case <-time.After(time.Second):
+		t.Fatal("expected the retried job against b to resolve")
+	}
+}
+
+func TestWorkManager_SubmitQueuesAJobWhenItsOnlyCandidateIsSaturated(t *testing.T) {
+	a := mesh.PeerName(1)
+	sender := &fakeSender{results: map[mesh.PeerName]error{}} // every send is left pending, as if awaiting a reply.
+	manager := NewWorkManager(sender, NewPeerRanking(1), time.Minute, NewMemStore())
+	sender.manager = manager
+
+	// Both jobs target the same peer, whose in-flight cap is 1: the second
+	// should be queued rather than failed outright.
+	task := newTask(context.Background(), 1, []byte("reply-to"), []mesh.PeerName{a, a}, []byte("payload"))
+	manager.Submit(task)
+
+	require.Len(t, sender.sentIDs(), 1, "the second job should be queued, not dispatched, while a is saturated")
+	select {
+	case <-task.Results:
+		t.Fatal("no job should have resolved yet")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	manager.Deliver(sender.sentIDs()[0], []byte("ok"))
+	select {
+	case resp := <-task.Results:
+		assert.NoError(t, resp.Err)
+	case <-time.After(time.Second):
+		t.Fatal("expected the first job to resolve")
+	}
+
+	require.Eventually(t, func() bool { return len(sender.sentIDs()) == 2 }, time.Second, 10*time.Millisecond,
+		"resolving the first job should free a's slot and dispatch the queued second job")
+}
+
+func TestWorkManager_ExhaustsWhenNoUntriedPeerIsLeft(t *testing.T) {
+	a := mesh.PeerName(1)
+	sender := &fakeSender{results: map[mesh.PeerName]error{a: assert.AnError}}
+	manager := NewWorkManager(sender, NewPeerRanking(1), time.Minute, NewMemStore())
+	sender.manager = manager
+
+	task := newTask(context.Background(), 1, []byte("reply-to"), []mesh.PeerName{a}, []byte("payload"))
+	manager.Submit(task)
+
+	select {
+	case resp := <-task.Results:
+		assert.Equal(t, errExhausted, resp.Err)
+	case <-time.After(time.Second):
+		t.Fatal("expected the job to exhaust its only candidate peer")
+	}
+}
+
+func TestWorkManager_OnAbandonFiresOnError(t *testing.T) {
+	a, b := mesh.PeerName(1), mesh.PeerName(2)
+	sender := &fakeSender{results: map[mesh.PeerName]error{
+		a: assert.AnError,
+		b: nil,
+	}}
+	manager := NewWorkManager(sender, NewPeerRanking(1), time.Minute, NewMemStore())
+	sender.manager = manager
+
+	var abandoned []uint32
+	var mu sync.Mutex
+	manager.OnAbandon(func(id uint32) {
+		mu.Lock()
+		abandoned = append(abandoned, id)
+		mu.Unlock()
+	})
+
+	task := newTask(context.Background(), 1, []byte("reply-to"), []mesh.PeerName{a, b}, []byte("payload"))
+	manager.Submit(task)
+
+	select {
+	case <-task.Results:
+	case <-time.After(time.Second):
+		t.Fatal("expected the task to resolve")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, abandoned, 1, "the attempt against a should have been reported abandoned")
+}
+
+func TestWorkManager_RecoverReplaysPartialResponsesAndRedispatchesTheRest(t *testing.T) {
+	a, b := mesh.PeerName(1), mesh.PeerName(2)
+	store := NewMemStore()
+	require.NoError(t, store.Put(AwaiterRecord{
+		ID:            1,
+		Channel:       []byte("reply-to"),
+		Payload:       []byte("payload"),
+		ExpectedPeers: []mesh.PeerName{a, b},
+	}))
+	require.NoError(t, store.MarkReceived(1, a, []byte("from-a")))
+
+	sender := &fakeSender{results: map[mesh.PeerName]error{b: nil}}
+	manager := NewWorkManager(sender, NewPeerRanking(1), time.Minute, store)
+	sender.manager = manager
+
+	tasks, err := manager.Recover()
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	task := tasks[0]
+
+	var got []Response
+	for i := 0; i < 2; i++ {
+		select {
+		case resp := <-task.Results:
+			got = append(got, resp)
+		case <-time.After(time.Second):
+			t.Fatalf("expected 2 responses, only got %d", len(got))
+		}
+	}
+
+	var peers []mesh.PeerName
+	for _, resp := range got {
+		peers = append(peers, resp.Peer)
+	}
+	assert.ElementsMatch(t, []mesh.PeerName{a, b}, peers, "the buffered response from a and the fresh dispatch to b should both resolve")
+
+	_, open := <-task.Results
+	assert.False(t, open, "task should close once every peer has resolved")
+}
+
+func TestWorkManager_RecoverClosesAndDeletesAFullyAnsweredTask(t *testing.T) {
+	a := mesh.PeerName(1)
+	store := NewMemStore()
+	require.NoError(t, store.Put(AwaiterRecord{
+		ID:            1,
+		Channel:       []byte("reply-to"),
+		Payload:       []byte("payload"),
+		ExpectedPeers: []mesh.PeerName{a},
+	}))
+	require.NoError(t, store.MarkReceived(1, a, []byte("from-a")))
+
+	manager := NewWorkManager(&fakeSender{}, NewPeerRanking(1), time.Minute, store)
+
+	tasks, err := manager.Recover()
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	task := tasks[0]
+
+	resp := <-task.Results
+	assert.Equal(t, a, resp.Peer)
+	_, open := <-task.Results
+	assert.False(t, open, "a fully-answered task should close its Results channel immediately")
+
+	records, err := store.List()
+	require.NoError(t, err)
+	assert.Empty(t, records, "a fully-answered task should delete its record from the store")
+}
+
+func TestExclude(t *testing.T) {
+	all := []mesh.PeerName{1, 2, 3}
+	tried := []mesh.PeerName{2}
+	assert.Equal(t, []mesh.PeerName{1, 3}, exclude(all, tried))
+	assert.Equal(t, []mesh.PeerName{}, exclude(tried, tried))
+}
@@ -0,0 +1,26 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package query
+
+import "errors"
+
+// errExhausted is returned when a job has been retried against every
+// candidate peer without success.
+var errExhausted = errors.New("query: job exhausted all candidate peers")
+
+// ErrAbandoned is the error a caller of WorkManager.OnAbandon/Dispatcher's
+// equivalent should record against an abandoned attempt's id, e.g. onto a
+// trace span, before its replacement (if any) is dispatched under a new id.
+var ErrAbandoned = errors.New("query: dispatch attempt abandoned")
@@ -0,0 +1,79 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+// Package query implements a work-dispatching subsystem for cluster-wide
+// queries. A single logical Task is fanned out into a batch of per-peer
+// Jobs, which the WorkManager schedules against a PeerRanking so that
+// traffic degrades gracefully instead of blocking on the slowest or a
+// failed peer.
+package query
+
+import (
+	"context"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Response represents a single reply produced by a dispatched job.
+type Response struct {
+	Peer    mesh.PeerName // The peer that produced the response.
+	Payload []byte        // The response payload.
+	Err     error         // Set when the job failed (timeout or peer error).
+}
+
+// Job represents a single unit of work addressed to one peer.
+type Job struct {
+	Peer     mesh.PeerName   // The target peer for this job.
+	Channel  []byte          // The reply-to channel to publish the job under.
+	Payload  []byte          // The request payload to send.
+	task     *Task           // The parent task this job belongs to.
+	tried    []mesh.PeerName // Every peer this job has already been sent to.
+}
+
+// Task represents one logical query fanned out into a batch of jobs, one
+// per selected peer. Results are streamed onto the Results channel as they
+// arrive, and the channel is closed once every job has either succeeded or
+// exhausted its retries.
+type Task struct {
+	ID      uint32          // The unique identifier of the task.
+	Jobs    []*Job          // The batch of jobs to dispatch.
+	Results chan Response   // The channel onto which responses are delivered.
+	ctx     context.Context // The context the originating request was issued under, carried so Sender.Send can start each job's span as its child.
+	peers   []mesh.PeerName // Every candidate peer, used to retry a failed job.
+	pending int32           // The number of jobs still outstanding.
+}
+
+// newTask creates a task with a job for every candidate peer. ctx is
+// threaded down to every job dispatched for the task, so a Sender can trace
+// it back to the request that spawned it.
+func newTask(ctx context.Context, id uint32, channel []byte, peers []mesh.PeerName, payload []byte) *Task {
+	t := &Task{
+		ID:      id,
+		Jobs:    make([]*Job, 0, len(peers)),
+		Results: make(chan Response, len(peers)),
+		ctx:     ctx,
+		peers:   peers,
+		pending: int32(len(peers)),
+	}
+
+	for _, peer := range peers {
+		t.Jobs = append(t.Jobs, &Job{
+			Peer:    peer,
+			Channel: channel,
+			Payload: payload,
+			task:    t,
+		})
+	}
+	return t
+}
@@ -0,0 +1,130 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package query
+
+import (
+	"fmt"
+	"strings"
+)
+
+// clause represents a single `key='value'` or `key LIKE 'value'` predicate.
+type clause struct {
+	key   string
+	like  bool
+	value string
+}
+
+// Query is a compiled predicate matched against an incoming request's
+// attributes, e.g. `type='presence' AND channel LIKE 'chat/*'`. The empty
+// expression compiles to a predicate that matches everything.
+type Query struct {
+	expr    string
+	clauses []clause
+}
+
+// ParseQuery compiles expr into a Query. Clauses are joined with " AND "
+// and each one is either `key='value'` for an exact match or
+// `key LIKE 'value'` for a prefix/suffix glob match (a single trailing or
+// leading '*' is supported).
+func ParseQuery(expr string) (*Query, error) {
+	q := &Query{expr: expr}
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return q, nil
+	}
+
+	for _, part := range strings.Split(expr, " AND ") {
+		c, err := parseClause(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		q.clauses = append(q.clauses, c)
+	}
+	return q, nil
+}
+
+// parseClause compiles a single `key='value'` or `key LIKE 'value'` clause.
+func parseClause(part string) (clause, error) {
+	if key, value, ok := cut(part, " LIKE "); ok {
+		return clause{key: key, like: true, value: unquote(value)}, nil
+	}
+	if key, value, ok := cut(part, "="); ok {
+		return clause{key: key, value: unquote(value)}, nil
+	}
+	return clause{}, fmt.Errorf("query: invalid clause %q", part)
+}
+
+// cut splits part on the first occurrence of sep, trimming whitespace from
+// both sides.
+func cut(part, sep string) (key, value string, ok bool) {
+	idx := strings.Index(part, sep)
+	if idx < 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(part[:idx]), strings.TrimSpace(part[idx+len(sep):]), true
+}
+
+// unquote strips a single pair of surrounding quotes, if present.
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// typeValue returns the exact value of the query's `type` clause, if it has
+// one. The bus uses this to index subscriptions by query type instead of
+// scanning every subscription on every publish.
+func (q *Query) typeValue() (string, bool) {
+	for _, c := range q.clauses {
+		if c.key == "type" && !c.like {
+			return c.value, true
+		}
+	}
+	return "", false
+}
+
+// Matches reports whether every clause of the query is satisfied by attrs.
+func (q *Query) Matches(attrs map[string]string) bool {
+	for _, c := range q.clauses {
+		v, ok := attrs[c.key]
+		if !ok {
+			return false
+		}
+		if c.like {
+			if !likeMatch(c.value, v) {
+				return false
+			}
+			continue
+		}
+		if v != c.value {
+			return false
+		}
+	}
+	return true
+}
+
+// likeMatch matches v against a pattern with at most one trailing or
+// leading '*' wildcard, e.g. "chat/*" or "*/history".
+func likeMatch(pattern, v string) bool {
+	switch {
+	case strings.HasSuffix(pattern, "*"):
+		return strings.HasPrefix(v, pattern[:len(pattern)-1])
+	case strings.HasPrefix(pattern, "*"):
+		return strings.HasSuffix(v, pattern[1:])
+	default:
+		return v == pattern
+	}
+}
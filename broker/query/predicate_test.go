@@ -0,0 +1,73 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQuery_EmptyExprMatchesEverything(t *testing.T) {
+	q, err := ParseQuery("")
+	require.NoError(t, err)
+	assert.True(t, q.Matches(map[string]string{"type": "presence"}))
+	assert.True(t, q.Matches(nil))
+}
+
+func TestParseQuery_ExactClause(t *testing.T) {
+	q, err := ParseQuery("type='presence'")
+	require.NoError(t, err)
+	assert.True(t, q.Matches(map[string]string{"type": "presence"}))
+	assert.False(t, q.Matches(map[string]string{"type": "history"}))
+	assert.False(t, q.Matches(map[string]string{}))
+}
+
+func TestParseQuery_LikePrefix(t *testing.T) {
+	q, err := ParseQuery("channel LIKE 'chat/*'")
+	require.NoError(t, err)
+	assert.True(t, q.Matches(map[string]string{"channel": "chat/room1"}))
+	assert.False(t, q.Matches(map[string]string{"channel": "history/room1"}))
+}
+
+func TestParseQuery_LikeSuffix(t *testing.T) {
+	q, err := ParseQuery("channel LIKE '*/history'")
+	require.NoError(t, err)
+	assert.True(t, q.Matches(map[string]string{"channel": "chat/history"}))
+	assert.False(t, q.Matches(map[string]string{"channel": "chat/room1"}))
+}
+
+func TestParseQuery_MultiClauseAND(t *testing.T) {
+	q, err := ParseQuery("type='presence' AND channel LIKE 'chat/*'")
+	require.NoError(t, err)
+	assert.True(t, q.Matches(map[string]string{"type": "presence", "channel": "chat/room1"}))
+	assert.False(t, q.Matches(map[string]string{"type": "history", "channel": "chat/room1"}))
+	assert.False(t, q.Matches(map[string]string{"type": "presence", "channel": "history/room1"}))
+}
+
+func TestParseQuery_QuotedValueIsUnquoted(t *testing.T) {
+	q, err := ParseQuery("type='presence'")
+	require.NoError(t, err)
+	typeVal, ok := q.typeValue()
+	require.True(t, ok)
+	assert.Equal(t, "presence", typeVal)
+}
+
+func TestParseQuery_InvalidClauseReturnsError(t *testing.T) {
+	_, err := ParseQuery("type presence")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid clause")
+}
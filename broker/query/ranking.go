@@ -0,0 +1,138 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package query
+
+import (
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// decay is how much a penalised peer's score is pulled back towards zero on
+// every subsequent successful response, so that a peer which recovers is
+// eventually trusted with work again.
+const decay = 0.5
+
+// peerScore tracks a single peer's recent performance.
+type peerScore struct {
+	latency  time.Duration // The last observed response latency.
+	timeouts float64       // The decayed count of recent timeouts.
+	errors   float64       // The decayed count of recent errors.
+	inflight int           // The number of jobs currently outstanding for this peer.
+}
+
+// value computes a lower-is-better ranking score for the peer: recent
+// latency plus a heavy penalty for timeouts and errors.
+func (s *peerScore) value() float64 {
+	return float64(s.latency.Milliseconds()) + s.timeouts*500 + s.errors*250
+}
+
+// PeerRanking scores peers by recent response latency, timeout rate and
+// error rate, and selects the best eligible, non-saturated peer for the
+// next job. It is safe for concurrent use.
+type PeerRanking struct {
+	mu          sync.Mutex
+	scores      map[mesh.PeerName]*peerScore
+	maxInFlight int
+}
+
+// NewPeerRanking creates a ranking which caps the number of jobs allowed
+// in-flight to any single peer at maxInFlight.
+func NewPeerRanking(maxInFlight int) *PeerRanking {
+	return &PeerRanking{
+		scores:      make(map[mesh.PeerName]*peerScore),
+		maxInFlight: maxInFlight,
+	}
+}
+
+// get returns (creating if necessary) the score tracked for a peer. Callers
+// must hold r.mu.
+func (r *PeerRanking) get(peer mesh.PeerName) *peerScore {
+	s, ok := r.scores[peer]
+	if !ok {
+		s = new(peerScore)
+		r.scores[peer] = s
+	}
+	return s
+}
+
+// Best returns the highest-ranked candidate that is not already saturated,
+// reserving an in-flight slot for it. It returns false if every candidate
+// is currently saturated.
+func (r *PeerRanking) Best(candidates []mesh.PeerName) (mesh.PeerName, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var best mesh.PeerName
+	bestValue := float64(0)
+	found := false
+
+	for _, peer := range candidates {
+		s := r.get(peer)
+		if s.inflight >= r.maxInFlight {
+			continue
+		}
+		if v := s.value(); !found || v < bestValue {
+			best, bestValue, found = peer, v, true
+		}
+	}
+
+	if found {
+		r.get(best).inflight++
+	}
+	return best, found
+}
+
+// Success records a successful response from a peer, boosting its score
+// and releasing its reserved in-flight slot.
+func (r *PeerRanking) Success(peer mesh.PeerName, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.get(peer)
+	s.latency = latency
+	s.timeouts *= decay
+	s.errors *= decay
+	if s.inflight > 0 {
+		s.inflight--
+	}
+}
+
+// Timeout records a job that timed out against a peer, decaying its score
+// and releasing its reserved in-flight slot.
+func (r *PeerRanking) Timeout(peer mesh.PeerName) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.get(peer)
+	s.timeouts++
+	if s.inflight > 0 {
+		s.inflight--
+	}
+}
+
+// Error records a job that a peer answered with an error, decaying its
+// score and releasing its reserved in-flight slot.
+func (r *PeerRanking) Error(peer mesh.PeerName) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.get(peer)
+	s.errors++
+	if s.inflight > 0 {
+		s.inflight--
+	}
+}
@@ -0,0 +1,69 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package query
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/weaveworks/mesh"
+)
+
+func TestPeerRanking_BestPrefersLowerScore(t *testing.T) {
+	r := NewPeerRanking(1)
+	a, b := mesh.PeerName(1), mesh.PeerName(2)
+
+	r.Success(a, 10*time.Millisecond)
+	r.Success(b, 100*time.Millisecond)
+
+	peer, ok := r.Best([]mesh.PeerName{a, b})
+	assert.True(t, ok)
+	assert.Equal(t, a, peer)
+}
+
+func TestPeerRanking_TimeoutPenalises(t *testing.T) {
+	r := NewPeerRanking(1)
+	a, b := mesh.PeerName(1), mesh.PeerName(2)
+
+	r.Success(a, 10*time.Millisecond)
+	r.Success(b, 10*time.Millisecond)
+	r.Timeout(b)
+
+	peer, ok := r.Best([]mesh.PeerName{a, b})
+	assert.True(t, ok)
+	assert.Equal(t, a, peer)
+}
+
+func TestPeerRanking_BestExcludesSaturatedPeers(t *testing.T) {
+	r := NewPeerRanking(1)
+	a := mesh.PeerName(1)
+
+	_, ok := r.Best([]mesh.PeerName{a})
+	assert.True(t, ok, "first reservation should succeed")
+
+	_, ok = r.Best([]mesh.PeerName{a})
+	assert.False(t, ok, "second reservation should find a saturated peer")
+
+	r.Success(a, time.Millisecond)
+	_, ok = r.Best([]mesh.PeerName{a})
+	assert.True(t, ok, "a released slot should be reusable")
+}
+
+func TestPeerRanking_BestReturnsFalseForNoCandidates(t *testing.T) {
+	r := NewPeerRanking(1)
+	_, ok := r.Best(nil)
+	assert.False(t, ok)
+}
@@ -0,0 +1,120 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package query
+
+import (
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// AwaiterRecord captures everything needed to resume a single outstanding
+// task across a broker restart: the request itself, so an unanswered peer
+// can be re-dispatched, and which peers have already replied, so their
+// responses are replayed instead of asked for again.
+type AwaiterRecord struct {
+	ID            uint32                   // The task's id, shared with Task.ID.
+	Channel       []byte                   // The reply-to channel the request was published under.
+	Payload       []byte                   // The request payload.
+	IssuedAt      time.Time                // When the task was first submitted.
+	ExpectedPeers []mesh.PeerName          // Every peer the task was fanned out to.
+	ReceivedFrom  map[mesh.PeerName][]byte // Responses already received, keyed by peer.
+}
+
+// AwaiterStore persists AwaiterRecords so that Dispatcher.Recover can reopen
+// outstanding tasks after a broker restart instead of silently dropping
+// in-flight responses. This matters for long-running administrative queries
+// (e.g. keyspace scans) where reissuing every outstanding query after a
+// single node bounce would be disruptive to the operator.
+//
+// Put is called once a task is submitted, MarkReceived each time one of its
+// jobs resolves successfully, and Delete once every job has resolved.
+type AwaiterStore interface {
+	// Put records a newly submitted task.
+	Put(rec AwaiterRecord) error
+	// MarkReceived records that peer answered the task identified by id with
+	// payload, so a later Recover can replay it without re-querying peer.
+	MarkReceived(id uint32, peer mesh.PeerName, payload []byte) error
+	// Delete removes a task's record once every job has resolved.
+	Delete(id uint32) error
+	// List returns every record still outstanding, e.g. at startup.
+	List() ([]AwaiterRecord, error)
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// memStore is the default AwaiterStore: it keeps records in memory only, so
+// a real process restart leaves nothing for Recover to replay. It exists so
+// that a Dispatcher constructed without an explicit store behaves exactly as
+// it did before persistence was introduced.
+type memStore struct {
+	mu      sync.Mutex
+	records map[uint32]AwaiterRecord
+}
+
+// NewMemStore creates an AwaiterStore backed by an in-memory map. It is the
+// default used when NewDispatcher is given a nil store.
+func NewMemStore() AwaiterStore {
+	return &memStore{records: make(map[uint32]AwaiterRecord)}
+}
+
+// Put implements AwaiterStore.
+func (s *memStore) Put(rec AwaiterRecord) error {
+	if rec.ReceivedFrom == nil {
+		rec.ReceivedFrom = make(map[mesh.PeerName][]byte)
+	}
+	s.mu.Lock()
+	s.records[rec.ID] = rec
+	s.mu.Unlock()
+	return nil
+}
+
+// MarkReceived implements AwaiterStore.
+func (s *memStore) MarkReceived(id uint32, peer mesh.PeerName, payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.records[id]
+	if !ok {
+		return nil
+	}
+	rec.ReceivedFrom[peer] = payload
+	s.records[id] = rec
+	return nil
+}
+
+// Delete implements AwaiterStore.
+func (s *memStore) Delete(id uint32) error {
+	s.mu.Lock()
+	delete(s.records, id)
+	s.mu.Unlock()
+	return nil
+}
+
+// List implements AwaiterStore.
+func (s *memStore) List() ([]AwaiterRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]AwaiterRecord, 0, len(s.records))
+	for _, rec := range s.records {
+		out = append(out, rec)
+	}
+	return out, nil
+}
+
+// Close implements AwaiterStore.
+func (s *memStore) Close() error {
+	return nil
+}
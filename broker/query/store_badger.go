@@ -0,0 +1,163 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package query
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/weaveworks/mesh"
+)
+
+// awaiterKeyPrefix namespaces awaiter records within a BadgerStore's
+// keyspace, in case the database ends up shared with other persisted state.
+var awaiterKeyPrefix = []byte("awaiter/")
+
+// BadgerStore is an AwaiterStore backed by a Badger key-value database, so
+// outstanding tasks survive a broker restart instead of living only in
+// process memory.
+type BadgerStore struct {
+	db          *badger.DB
+	onDecodeErr func(key []byte, err error) // Notified of a record List could not decode, if set.
+}
+
+// NewBadgerStore opens (creating if necessary) a Badger database under dir
+// and returns an AwaiterStore backed by it. The caller is responsible for
+// calling Close once the store is no longer needed.
+func NewBadgerStore(dir string) (*BadgerStore, error) {
+	db, err := badger.Open(badger.DefaultOptions(dir))
+	if err != nil {
+		return nil, fmt.Errorf("query: opening badger store at %q: %w", dir, err)
+	}
+	return &BadgerStore{db: db}, nil
+}
+
+// OnDecodeError registers fn to be called with the key of any record List
+// skips because it failed to decode, so a caller can surface the loss (e.g.
+// onto a trace span) instead of it passing silently. Only one callback is
+// kept; a later call replaces an earlier one. It is optional: with no
+// callback registered, an undecodable record is simply skipped.
+func (s *BadgerStore) OnDecodeError(fn func(key []byte, err error)) {
+	s.onDecodeErr = fn
+}
+
+// Put implements AwaiterStore.
+func (s *BadgerStore) Put(rec AwaiterRecord) error {
+	if rec.ReceivedFrom == nil {
+		rec.ReceivedFrom = make(map[mesh.PeerName][]byte)
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		return putAwaiter(txn, rec)
+	})
+}
+
+// MarkReceived implements AwaiterStore.
+func (s *BadgerStore) MarkReceived(id uint32, peer mesh.PeerName, payload []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		rec, ok, err := getAwaiter(txn, id)
+		if err != nil || !ok {
+			return err
+		}
+		if rec.ReceivedFrom == nil {
+			// gob treats a zero-length map as the field's zero value and
+			// never encodes it, so a record persisted with no responses
+			// yet decodes back with a nil ReceivedFrom.
+			rec.ReceivedFrom = make(map[mesh.PeerName][]byte)
+		}
+		rec.ReceivedFrom[peer] = payload
+		return putAwaiter(txn, rec)
+	})
+}
+
+// Delete implements AwaiterStore.
+func (s *BadgerStore) Delete(id uint32) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(awaiterKey(id))
+	})
+}
+
+// List implements AwaiterStore. A record that fails to decode (e.g. it was
+// written by an incompatible version, or the underlying value is corrupt) is
+// skipped rather than aborting the scan, so one bad awaiter does not cost
+// every other outstanding task its chance to resume.
+func (s *BadgerStore) List() ([]AwaiterRecord, error) {
+	var out []AwaiterRecord
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = awaiterKeyPrefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(awaiterKeyPrefix); it.ValidForPrefix(awaiterKeyPrefix); it.Next() {
+			rec, err := decodeAwaiter(it.Item())
+			if err != nil {
+				if s.onDecodeErr != nil {
+					s.onDecodeErr(it.Item().KeyCopy(nil), err)
+				}
+				continue
+			}
+			out = append(out, rec)
+		}
+		return nil
+	})
+	return out, err
+}
+
+// Close implements AwaiterStore.
+func (s *BadgerStore) Close() error {
+	return s.db.Close()
+}
+
+// awaiterKey encodes id into a key sorting after awaiterKeyPrefix, so List
+// can iterate the keyspace with a single prefix scan.
+func awaiterKey(id uint32) []byte {
+	key := make([]byte, len(awaiterKeyPrefix)+4)
+	copy(key, awaiterKeyPrefix)
+	binary.BigEndian.PutUint32(key[len(awaiterKeyPrefix):], id)
+	return key
+}
+
+// getAwaiter looks up id within txn, returning ok=false if no record exists.
+func getAwaiter(txn *badger.Txn, id uint32) (AwaiterRecord, bool, error) {
+	item, err := txn.Get(awaiterKey(id))
+	switch {
+	case err == badger.ErrKeyNotFound:
+		return AwaiterRecord{}, false, nil
+	case err != nil:
+		return AwaiterRecord{}, false, err
+	}
+	rec, err := decodeAwaiter(item)
+	return rec, err == nil, err
+}
+
+// putAwaiter gob-encodes rec and writes it under its key within txn.
+func putAwaiter(txn *badger.Txn, rec AwaiterRecord) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+		return err
+	}
+	return txn.Set(awaiterKey(rec.ID), buf.Bytes())
+}
+
+// decodeAwaiter gob-decodes the AwaiterRecord stored in item.
+func decodeAwaiter(item *badger.Item) (rec AwaiterRecord, err error) {
+	err = item.Value(func(v []byte) error {
+		return gob.NewDecoder(bytes.NewReader(v)).Decode(&rec)
+	})
+	return rec, err
+}
@@ -0,0 +1,59 @@
+/**********************************************************************************
+* Copyright (c) 2009-2017 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestMemStore_PutMarkReceivedListDeleteRoundTrip(t *testing.T) {
+	s := NewMemStore()
+	a, b := mesh.PeerName(1), mesh.PeerName(2)
+
+	require.NoError(t, s.Put(AwaiterRecord{
+		ID:            1,
+		Channel:       []byte("reply-to"),
+		Payload:       []byte("payload"),
+		ExpectedPeers: []mesh.PeerName{a, b},
+	}))
+
+	records, err := s.List()
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Empty(t, records[0].ReceivedFrom)
+
+	require.NoError(t, s.MarkReceived(1, a, []byte("from-a")))
+	records, err = s.List()
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, []byte("from-a"), records[0].ReceivedFrom[a])
+
+	require.NoError(t, s.Delete(1))
+	records, err = s.List()
+	require.NoError(t, err)
+	assert.Empty(t, records)
+}
+
+func TestMemStore_MarkReceivedUnknownIDIsANoop(t *testing.T) {
+	s := NewMemStore()
+	assert.NoError(t, s.MarkReceived(99, mesh.PeerName(1), []byte("payload")))
+	records, err := s.List()
+	require.NoError(t, err)
+	assert.Empty(t, records)
+}